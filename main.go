@@ -27,105 +27,1456 @@ HEIC Converter for converting .HEIC images to other formats like JPEG or PNG
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"image"
+	"image/color"
 	"image/jpeg"
 	"image/png"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
 
+	"github.com/chai2010/webp"
 	"github.com/strukturag/libheif/go/heif"
+	"golang.org/x/image/tiff"
 )
 
-// Saves an image as a JPEG file with the specified quality and filename.
-func saveJPEG(img image.Image, filename string, quality int) {
+// stringListFlag collects the values of a flag that may be passed multiple
+// times (e.g. --input_dir a --input_dir b) into a slice.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// exifSegmentMarker is the standard APP1 marker prefix identifying an Exif payload.
+const exifSegmentMarker = "Exif\x00\x00"
+
+// xmpSegmentMarker is the standard APP1 marker prefix identifying an XMP payload.
+const xmpSegmentMarker = "http://ns.adobe.com/xap/1.0/\x00"
+
+// metadata holds the raw Exif, XMP, and ICC color profile blocks extracted
+// for one item of a HEIC file.
+type metadata struct {
+	exif      []byte
+	xmp       []byte
+	icc       []byte
+	displayP3 bool // set when the item's color profile is (or claims to be) Display P3
+}
+
+// libheif's Go bindings (github.com/strukturag/libheif/go/heif) don't expose
+// Exif/XMP metadata at all, so the functions below read it directly out of
+// the HEIC file's ISO-BMFF ("meta") box instead of going through
+// *heif.ImageHandle. Only the subset of the box layouts needed to locate
+// Exif and XMP items is implemented.
+
+// isoItemExtent is one contiguous byte range of an item's data, as described
+// by an ISO-BMFF "iloc" entry.
+type isoItemExtent struct {
+	offset int64
+	length int64
+}
+
+// isoItemInfo is the subset of an "infe" item info entry needed to recognize
+// Exif and XMP items.
+type isoItemInfo struct {
+	id          int
+	itemType    string
+	contentType string // populated for "mime" items, e.g. "application/rdf+xml"
+}
+
+// nextIsoBox reads one ISO-BMFF box header from the front of data and returns
+// its 4-character type, its payload, and the bytes following it.
+func nextIsoBox(data []byte) (boxType string, payload []byte, rest []byte, ok bool) {
+	if len(data) < 8 {
+		return "", nil, nil, false
+	}
+	size := uint64(be32(data[0:4]))
+	boxType = string(data[4:8])
+	headerLen := 8
+	switch size {
+	case 1:
+		if len(data) < 16 {
+			return "", nil, nil, false
+		}
+		size = be64(data[8:16])
+		headerLen = 16
+	case 0:
+		size = uint64(len(data))
+	}
+	if size < uint64(headerLen) || uint64(len(data)) < size {
+		return "", nil, nil, false
+	}
+	return boxType, data[headerLen:size], data[size:], true
+}
+
+// findIsoBox returns the payload of the first direct child of data with the
+// given box type.
+func findIsoBox(data []byte, boxType string) ([]byte, bool) {
+	for len(data) > 0 {
+		t, payload, rest, ok := nextIsoBox(data)
+		if !ok {
+			return nil, false
+		}
+		if t == boxType {
+			return payload, true
+		}
+		data = rest
+	}
+	return nil, false
+}
+
+func be16(b []byte) uint16 { return uint16(b[0])<<8 | uint16(b[1]) }
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func be64(b []byte) uint64 {
+	return uint64(be32(b[0:4]))<<32 | uint64(be32(b[4:8]))
+}
+
+// readUintBE reads an n-byte (0, 4, or 8 in practice) big-endian unsigned
+// integer from the front of *data, advancing it past the bytes consumed.
+// n==0 yields 0, as required by iloc's optional size fields.
+func readUintBE(data *[]byte, n int) (uint64, bool) {
+	if n == 0 {
+		return 0, true
+	}
+	if len(*data) < n {
+		return 0, false
+	}
+	var v uint64
+	for _, b := range (*data)[:n] {
+		v = v<<8 | uint64(b)
+	}
+	*data = (*data)[n:]
+	return v, true
+}
+
+func skipIsoCString(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[i+1:]
+		}
+	}
+	return nil
+}
+
+func readIsoCString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// parseItemInfos parses an "iinf" box's "infe" entries. Only version >= 2
+// entries are understood, which covers every HEIC encoder in practical use.
+func parseItemInfos(iinf []byte) []isoItemInfo {
+	if len(iinf) < 4 {
+		return nil
+	}
+	version := iinf[0]
+	data := iinf[4:]
+
+	var count int
+	if version == 0 {
+		if len(data) < 2 {
+			return nil
+		}
+		count = int(be16(data))
+		data = data[2:]
+	} else {
+		if len(data) < 4 {
+			return nil
+		}
+		count = int(be32(data))
+		data = data[4:]
+	}
+
+	var infos []isoItemInfo
+	for i := 0; i < count; i++ {
+		t, payload, rest, ok := nextIsoBox(data)
+		if !ok || t != "infe" {
+			break
+		}
+		if info, ok := parseItemInfoEntry(payload); ok {
+			infos = append(infos, info)
+		}
+		data = rest
+	}
+	return infos
+}
+
+func parseItemInfoEntry(infe []byte) (isoItemInfo, bool) {
+	if len(infe) < 4 {
+		return isoItemInfo{}, false
+	}
+	version := infe[0]
+	data := infe[4:]
+	if version < 2 {
+		return isoItemInfo{}, false // legacy entries have no item_type, and aren't produced by any encoder we care about
+	}
+
+	var id int
+	if version == 2 {
+		if len(data) < 2 {
+			return isoItemInfo{}, false
+		}
+		id = int(be16(data))
+		data = data[2:]
+	} else {
+		if len(data) < 4 {
+			return isoItemInfo{}, false
+		}
+		id = int(be32(data))
+		data = data[4:]
+	}
+	if len(data) < 6 {
+		return isoItemInfo{}, false
+	}
+	data = data[2:] // item_protection_index
+	info := isoItemInfo{id: id, itemType: string(data[0:4])}
+	data = data[4:]
+
+	if info.itemType == "mime" {
+		data = skipIsoCString(data) // item_name
+		info.contentType = readIsoCString(data)
+	}
+	return info, true
+}
+
+// clampCount bounds an attacker-controlled item/entry count hint read from an
+// ISO-BMFF box to the bytes actually remaining, so a corrupted or hostile
+// count can never drive a multi-gigabyte allocation before the per-entry
+// bounds checks below get a chance to reject it.
+func clampCount(count int, remaining []byte) int {
+	if count < 0 || count > len(remaining) {
+		return len(remaining)
+	}
+	return count
+}
+
+// parseItemLocations parses an "iloc" box into each item's file byte ranges.
+// Only construction_method 0 (plain file offsets) is supported; that covers
+// how every mainstream HEIC encoder stores Exif, XMP, and thumbnail data.
+func parseItemLocations(iloc []byte) map[int][]isoItemExtent {
+	if len(iloc) < 4 {
+		return nil
+	}
+	version := iloc[0]
+	data := iloc[4:]
+	if len(data) < 2 {
+		return nil
+	}
+	offsetSize := int(data[0] >> 4)
+	lengthSize := int(data[0] & 0xF)
+	baseOffsetSize := int(data[1] >> 4)
+	indexSize := int(data[1] & 0xF)
+	data = data[2:]
+
+	var itemCount int
+	if version < 2 {
+		if len(data) < 2 {
+			return nil
+		}
+		itemCount = int(be16(data))
+		data = data[2:]
+	} else {
+		if len(data) < 4 {
+			return nil
+		}
+		itemCount = int(be32(data))
+		data = data[4:]
+	}
+
+	items := make(map[int][]isoItemExtent, clampCount(itemCount, data))
+	for i := 0; i < itemCount; i++ {
+		var itemID int
+		if version < 2 {
+			if len(data) < 2 {
+				return items
+			}
+			itemID = int(be16(data))
+			data = data[2:]
+		} else {
+			if len(data) < 4 {
+				return items
+			}
+			itemID = int(be32(data))
+			data = data[4:]
+		}
+
+		constructionMethod := 0
+		if version == 1 || version == 2 {
+			if len(data) < 2 {
+				return items
+			}
+			constructionMethod = int(be16(data) & 0xF)
+			data = data[2:]
+		}
+
+		if len(data) < 2 {
+			return items
+		}
+		data = data[2:] // data_reference_index
+
+		baseOffset, ok := readUintBE(&data, baseOffsetSize)
+		if !ok {
+			return items
+		}
+
+		if len(data) < 2 {
+			return items
+		}
+		extentCount := int(be16(data))
+		data = data[2:]
+
+		var extents []isoItemExtent
+		for e := 0; e < extentCount; e++ {
+			if indexSize > 0 {
+				if _, ok := readUintBE(&data, indexSize); !ok {
+					return items
+				}
+			}
+			extentOffset, ok := readUintBE(&data, offsetSize)
+			if !ok {
+				return items
+			}
+			extentLength, ok := readUintBE(&data, lengthSize)
+			if !ok {
+				return items
+			}
+			if constructionMethod == 0 {
+				extents = append(extents, isoItemExtent{
+					offset: int64(baseOffset) + int64(extentOffset),
+					length: int64(extentLength),
+				})
+			}
+		}
+		if len(extents) > 0 {
+			items[itemID] = extents
+		}
+	}
+	return items
+}
+
+// parseContentDescribes parses an "iref" box's "cdsc" ("content describes")
+// entries, returning for each metadata item ID the image item ID(s) it
+// describes. This is how a HEIC file links an Exif or XMP item to the image
+// it belongs to.
+func parseContentDescribes(iref []byte) map[int][]int {
+	if len(iref) < 4 {
+		return nil
+	}
+	version := iref[0]
+	data := iref[4:]
+
+	describes := make(map[int][]int)
+	for len(data) > 0 {
+		t, payload, rest, ok := nextIsoBox(data)
+		if !ok {
+			break
+		}
+		data = rest
+		if t != "cdsc" {
+			continue
+		}
+
+		var fromID int
+		if version == 0 {
+			if len(payload) < 2 {
+				continue
+			}
+			fromID = int(be16(payload))
+			payload = payload[2:]
+		} else {
+			if len(payload) < 4 {
+				continue
+			}
+			fromID = int(be32(payload))
+			payload = payload[4:]
+		}
+		if len(payload) < 2 {
+			continue
+		}
+		count := clampCount(int(be16(payload)), payload[2:])
+		payload = payload[2:]
+		for i := 0; i < count; i++ {
+			var toID int
+			if version == 0 {
+				if len(payload) < 2 {
+					break
+				}
+				toID = int(be16(payload))
+				payload = payload[2:]
+			} else {
+				if len(payload) < 4 {
+					break
+				}
+				toID = int(be32(payload))
+				payload = payload[4:]
+			}
+			describes[fromID] = append(describes[fromID], toID)
+		}
+	}
+	return describes
+}
+
+// isoColorProfile is a "colr" item property, either a raw ICC profile or an
+// on-the-fly nclx profile (which carries no ICC bytes, only primaries).
+type isoColorProfile struct {
+	icc       []byte
+	displayP3 bool
+}
+
+// parseColrBox parses a single "colr" item property. Types "prof"/"rICC"
+// carry a raw ICC profile; "nclx" only signals primaries/transfer/matrix, so
+// it carries no ICC bytes but can still identify a Display P3 image via
+// primaries code point 12 (SMPTE EG 432-1 / Display P3 D65).
+func parseColrBox(colr []byte) (isoColorProfile, bool) {
+	if len(colr) < 4 {
+		return isoColorProfile{}, false
+	}
+	switch string(colr[0:4]) {
+	case "prof", "rICC":
+		icc := colr[4:]
+		return isoColorProfile{icc: icc, displayP3: bytes.Contains(icc, []byte("Display P3"))}, true
+	case "nclx":
+		if len(colr) < 6 {
+			return isoColorProfile{}, false
+		}
+		return isoColorProfile{displayP3: be16(colr[4:6]) == 12}, true
+	default:
+		return isoColorProfile{}, false
+	}
+}
+
+// parseItemPropertyAssociations parses an "ipma" box into each item ID's
+// list of 1-based indices into the sibling "ipco" box.
+func parseItemPropertyAssociations(ipma []byte) map[int][]int {
+	if len(ipma) < 8 {
+		return nil
+	}
+	version := ipma[0]
+	largeIndex := be32(ipma[0:4])&0xFFFFFF&1 != 0
+	entryCount := int(be32(ipma[4:8]))
+	data := ipma[8:]
+
+	assoc := make(map[int][]int, clampCount(entryCount, data))
+	for e := 0; e < entryCount; e++ {
+		var itemID int
+		if version == 0 {
+			if len(data) < 2 {
+				break
+			}
+			itemID = int(be16(data))
+			data = data[2:]
+		} else {
+			if len(data) < 4 {
+				break
+			}
+			itemID = int(be32(data))
+			data = data[4:]
+		}
+		if len(data) < 1 {
+			break
+		}
+		assocCount := int(data[0])
+		data = data[1:]
+		for a := 0; a < assocCount; a++ {
+			var idx int
+			if largeIndex {
+				if len(data) < 2 {
+					break
+				}
+				idx = int(be16(data) & 0x7FFF)
+				data = data[2:]
+			} else {
+				if len(data) < 1 {
+					break
+				}
+				idx = int(data[0] & 0x7F)
+				data = data[1:]
+			}
+			assoc[itemID] = append(assoc[itemID], idx)
+		}
+	}
+	return assoc
+}
+
+// parseColorProfiles parses an "iprp" box's "ipco"/"ipma" pair, returning the
+// "colr" color profile associated with each item ID, if any.
+func parseColorProfiles(iprp []byte) map[int]isoColorProfile {
+	ipco, ok := findIsoBox(iprp, "ipco")
+	if !ok {
+		return nil
+	}
+	ipma, ok := findIsoBox(iprp, "ipma")
+	if !ok {
+		return nil
+	}
+
+	var colrProps [][]byte // 1-indexed; nil for non-colr properties
+	for len(ipco) > 0 {
+		t, payload, rest, ok := nextIsoBox(ipco)
+		if !ok {
+			break
+		}
+		if t == "colr" {
+			colrProps = append(colrProps, payload)
+		} else {
+			colrProps = append(colrProps, nil)
+		}
+		ipco = rest
+	}
+
+	profiles := make(map[int]isoColorProfile)
+	for itemID, indices := range parseItemPropertyAssociations(ipma) {
+		for _, idx := range indices {
+			if idx < 1 || idx > len(colrProps) || colrProps[idx-1] == nil {
+				continue
+			}
+			if profile, ok := parseColrBox(colrProps[idx-1]); ok {
+				profiles[itemID] = profile
+				break
+			}
+		}
+	}
+	return profiles
+}
+
+// parseContainerMetadata reads fileData's ISO-BMFF "meta" box and returns the
+// Exif, XMP, and ICC/Display-P3 information associated with each item ID (a
+// top-level image or a thumbnail). Any box it doesn't understand is skipped
+// rather than treated as an error, so a file with metadata this parser can't
+// read still converts, just without that metadata attached.
+func parseContainerMetadata(fileData []byte) map[int]metadata {
+	result := make(map[int]metadata)
+
+	meta, ok := findIsoBox(fileData, "meta")
+	if !ok || len(meta) < 4 {
+		return result
+	}
+	meta = meta[4:] // FullBox version/flags
+
+	iinf, _ := findIsoBox(meta, "iinf")
+	infos := parseItemInfos(iinf)
+
+	iloc, _ := findIsoBox(meta, "iloc")
+	locations := parseItemLocations(iloc)
+
+	iref, _ := findIsoBox(meta, "iref")
+	describes := parseContentDescribes(iref)
+
+	var colorProfiles map[int]isoColorProfile
+	if iprp, ok := findIsoBox(meta, "iprp"); ok {
+		colorProfiles = parseColorProfiles(iprp)
+	}
+
+	readExtents := func(id int) []byte {
+		var buf bytes.Buffer
+		for _, ext := range locations[id] {
+			if ext.offset < 0 || ext.length < 0 || ext.offset+ext.length > int64(len(fileData)) {
+				return nil
+			}
+			buf.Write(fileData[ext.offset : ext.offset+ext.length])
+		}
+		return buf.Bytes()
+	}
+
+	for _, info := range infos {
+		switch {
+		case info.itemType == "Exif":
+			data := readExtents(info.id)
+			if len(data) <= 4 {
+				continue
+			}
+			for _, imageID := range describes[info.id] {
+				m := result[imageID]
+				m.exif = data[4:] // drop the 4-byte TIFF offset prefix
+				result[imageID] = m
+			}
+		case info.itemType == "mime" && info.contentType == "application/rdf+xml":
+			xmp := readExtents(info.id)
+			for _, imageID := range describes[info.id] {
+				m := result[imageID]
+				m.xmp = xmp
+				result[imageID] = m
+			}
+		}
+	}
+
+	for itemID, profile := range colorProfiles {
+		m := result[itemID]
+		m.icc = profile.icc
+		m.displayP3 = profile.displayP3
+		result[itemID] = m
+	}
+
+	return result
+}
+
+// iccProfileMarker is the standard APP2 marker prefix identifying an ICC profile segment.
+const iccProfileMarker = "ICC_PROFILE\x00"
+
+// iccSegmentMaxSize is the largest ICC payload that fits in a single JPEG APP2
+// segment: the 64KB segment limit, minus the marker, minus the 2 chunk-numbering
+// bytes, minus the 2-byte segment length field itself (which counts toward the limit).
+const iccSegmentMaxSize = 65535 - len(iccProfileMarker) - 2 - 2
+
+// buildJPEGICCSegments splits icc into one or more APP2 "ICC_PROFILE" segments,
+// numbering each chunk as required by the ICC embedding spec for profiles
+// larger than a single JPEG segment can hold.
+func buildJPEGICCSegments(icc []byte) [][]byte {
+	if len(icc) == 0 {
+		return nil
+	}
+
+	var chunks [][]byte
+	for offset := 0; offset < len(icc); offset += iccSegmentMaxSize {
+		end := offset + iccSegmentMaxSize
+		if end > len(icc) {
+			end = len(icc)
+		}
+		chunks = append(chunks, icc[offset:end])
+	}
+
+	total := len(chunks)
+	var segments [][]byte
+	for i, chunk := range chunks {
+		content := append([]byte(iccProfileMarker), byte(i+1), byte(total))
+		content = append(content, chunk...)
+		length := len(content) + 2
+		seg := []byte{0xFF, 0xE2, byte(length >> 8), byte(length & 0xFF)}
+		segments = append(segments, append(seg, content...))
+	}
+	return segments
+}
+
+// buildPNGiCCPChunk zlib-compresses icc and wraps it in a PNG iCCP chunk
+// named "ICC profile" with the required deflate compression method byte.
+func buildPNGiCCPChunk(icc []byte) []byte {
+	if len(icc) == 0 {
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	_, _ = w.Write(icc)
+	_ = w.Close()
+
+	data := append([]byte("ICC profile\x00\x00"), compressed.Bytes()...)
+	return buildPNGChunk("iCCP", data)
+}
+
+// srgbFromDisplayP3 is the linear Display P3 -> linear sRGB conversion matrix.
+var srgbFromDisplayP3 = [3][3]float64{
+	{1.2249, -0.2247, 0.0000},
+	{-0.0420, 1.0419, 0.0000},
+	{-0.0197, -0.0786, 1.0979},
+}
+
+// convertDisplayP3ToSRGB re-renders img from Display P3 to sRGB by decoding
+// each pixel to linear light, applying the P3->sRGB matrix, and re-encoding
+// with the sRGB transfer function. Used by --convert-to-srgb as a lightweight
+// substitute for a full ICC-aware color management pipeline.
+func convertDisplayP3ToSRGB(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			lr := srgbToLinear(float64(r) / 65535)
+			lg := srgbToLinear(float64(g) / 65535)
+			lb := srgbToLinear(float64(bl) / 65535)
+
+			nr := srgbFromDisplayP3[0][0]*lr + srgbFromDisplayP3[0][1]*lg + srgbFromDisplayP3[0][2]*lb
+			ng := srgbFromDisplayP3[1][0]*lr + srgbFromDisplayP3[1][1]*lg + srgbFromDisplayP3[1][2]*lb
+			nb := srgbFromDisplayP3[2][0]*lr + srgbFromDisplayP3[2][1]*lg + srgbFromDisplayP3[2][2]*lb
+
+			dst.Set(x, y, color.NRGBA64{
+				R: linearToSRGB16(nr),
+				G: linearToSRGB16(ng),
+				B: linearToSRGB16(nb),
+				A: uint16(a),
+			})
+		}
+	}
+	return dst
+}
+
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB16(c float64) uint16 {
+	if c < 0 {
+		c = 0
+	} else if c > 1 {
+		c = 1
+	}
+	var s float64
+	if c <= 0.0031308 {
+		s = c * 12.92
+	} else {
+		s = 1.055*math.Pow(c, 1/2.4) - 0.055
+	}
+	return uint16(math.Round(s * 65535))
+}
+
+// exifOrientation returns the Exif Orientation tag value (1-8) found in the
+// given TIFF-formatted Exif payload, or 1 (no transformation) if it cannot be
+// determined.
+func exifOrientation(exif []byte) int {
+	if len(exif) < 8 {
+		return 1
+	}
+
+	var order binaryOrder
+	switch string(exif[0:2]) {
+	case "II":
+		order = littleEndian
+	case "MM":
+		order = bigEndian
+	default:
+		return 1
+	}
+
+	ifdOffset := order.u32(exif[4:8])
+	if int(ifdOffset)+2 > len(exif) {
+		return 1
+	}
+
+	entryCount := int(order.u16(exif[ifdOffset : ifdOffset+2]))
+	for i := 0; i < entryCount; i++ {
+		entryOffset := int(ifdOffset) + 2 + i*12
+		if entryOffset+12 > len(exif) {
+			break
+		}
+		tag := order.u16(exif[entryOffset : entryOffset+2])
+		if tag == 0x0112 { // Orientation
+			return int(order.u16(exif[entryOffset+8 : entryOffset+10]))
+		}
+	}
+
+	return 1
+}
+
+// normalizeExifOrientation returns a copy of exif with its Orientation entry
+// (if any) set to 1, so metadata re-embedded after applyOrientation has
+// already rotated the pixels doesn't tell viewers to rotate them again.
+func normalizeExifOrientation(exif []byte) []byte {
+	if len(exif) < 8 {
+		return exif
+	}
+
+	var order binaryOrder
+	switch string(exif[0:2]) {
+	case "II":
+		order = littleEndian
+	case "MM":
+		order = bigEndian
+	default:
+		return exif
+	}
+
+	ifdOffset := order.u32(exif[4:8])
+	if int(ifdOffset)+2 > len(exif) {
+		return exif
+	}
+
+	entryCount := int(order.u16(exif[ifdOffset : ifdOffset+2]))
+	out := append([]byte(nil), exif...)
+	for i := 0; i < entryCount; i++ {
+		entryOffset := int(ifdOffset) + 2 + i*12
+		if entryOffset+12 > len(out) {
+			break
+		}
+		if order.u16(out[entryOffset:entryOffset+2]) == 0x0112 { // Orientation
+			order.putU16(out[entryOffset+8:entryOffset+10], 1)
+			break
+		}
+	}
+	return out
+}
+
+// binaryOrder abstracts TIFF's little/big-endian byte order so exifOrientation
+// can be shared between Intel ("II") and Motorola ("MM") encoded Exif blocks.
+type binaryOrder int
+
+const (
+	littleEndian binaryOrder = iota
+	bigEndian
+)
+
+func (o binaryOrder) u16(b []byte) uint16 {
+	if o == littleEndian {
+		return uint16(b[0]) | uint16(b[1])<<8
+	}
+	return uint16(b[1]) | uint16(b[0])<<8
+}
+
+func (o binaryOrder) putU16(b []byte, v uint16) {
+	if o == littleEndian {
+		b[0], b[1] = byte(v), byte(v>>8)
+		return
+	}
+	b[0], b[1] = byte(v>>8), byte(v)
+}
+
+func (o binaryOrder) u32(b []byte) uint32 {
+	if o == littleEndian {
+		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	}
+	return uint32(b[3]) | uint32(b[2])<<8 | uint32(b[1])<<16 | uint32(b[0])<<24
+}
+
+// applyOrientation rotates/flips img so its pixels match the given Exif
+// Orientation value, returning img unchanged for orientation 1 or unknown values.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return flipH(img)
+	case 3:
+		return rotate180(img)
+	case 4:
+		return flipV(img)
+	case 5:
+		return flipH(rotate90(img))
+	case 6:
+		return rotate90(img)
+	case 7:
+		return flipH(rotate270(img))
+	case 8:
+		return rotate270(img)
+	default:
+		return img
+	}
+}
+
+func rotate90(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(b.Max.Y-1-y, x, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func rotate180(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(b.Max.X-1-x, b.Max.Y-1-y, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func rotate270(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(y, b.Max.X-1-x, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func flipH(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(b.Max.X-1-x, y, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+func flipV(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x, b.Max.Y-1-y, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+// injectJPEGSegments inserts the given pre-built APP1/APP2 marker segments
+// into a JPEG byte stream immediately after the SOI marker.
+func injectJPEGSegments(jpegData []byte, segments ...[]byte) []byte {
+	if len(jpegData) < 2 {
+		return jpegData
+	}
+
+	var out bytes.Buffer
+	out.Write(jpegData[0:2]) // SOI
+	for _, seg := range segments {
+		out.Write(seg)
+	}
+	out.Write(jpegData[2:])
+	return out.Bytes()
+}
+
+// buildJPEGApp1Segment wraps payload (prefixed with marker) as a JPEG APP1 segment.
+func buildJPEGApp1Segment(marker string, payload []byte) []byte {
+	content := append([]byte(marker), payload...)
+	length := len(content) + 2 // segment length includes itself, excludes the marker bytes
+	seg := []byte{0xFF, 0xE1, byte(length >> 8), byte(length & 0xFF)}
+	return append(seg, content...)
+}
+
+// buildPNGMetadataChunks returns the eXIf and/or iTXt chunks that carry the
+// given Exif/XMP payloads in the PNG output.
+func buildPNGMetadataChunks(m metadata) [][]byte {
+	var chunks [][]byte
+	if len(m.exif) > 0 {
+		chunks = append(chunks, buildPNGChunk("eXIf", m.exif))
+	}
+	if len(m.xmp) > 0 {
+		itxt := append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), m.xmp...)
+		chunks = append(chunks, buildPNGChunk("iTXt", itxt))
+	}
+	return chunks
+}
+
+func buildPNGChunk(chunkType string, data []byte) []byte {
+	var buf bytes.Buffer
+	length := make([]byte, 4)
+	length[0] = byte(len(data) >> 24)
+	length[1] = byte(len(data) >> 16)
+	length[2] = byte(len(data) >> 8)
+	length[3] = byte(len(data))
+	buf.Write(length)
+	buf.WriteString(chunkType)
+	buf.Write(data)
+
+	crc := crc32.ChecksumIEEE(append([]byte(chunkType), data...))
+	crcBytes := []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}
+	buf.Write(crcBytes)
+
+	return buf.Bytes()
+}
+
+// injectPNGChunks inserts the given ancillary chunks right after the IHDR
+// chunk of a PNG byte stream.
+func injectPNGChunks(pngData []byte, chunks ...[]byte) []byte {
+	const ihdrEnd = 8 /* signature */ + 4 /* length */ + 4 /* "IHDR" */ + 13 /* IHDR data */ + 4 /* CRC */
+	if len(pngData) < ihdrEnd {
+		return pngData
+	}
+
+	var out bytes.Buffer
+	out.Write(pngData[:ihdrEnd])
+	for _, chunk := range chunks {
+		out.Write(chunk)
+	}
+	out.Write(pngData[ihdrEnd:])
+	return out.Bytes()
+}
+
+// Saves an image as a JPEG file with the specified quality and filename,
+// embedding the given Exif/XMP metadata unless m is empty.
+func saveJPEG(img image.Image, filename string, quality int, m metadata) {
 	var out bytes.Buffer
 	opts := &jpeg.Options{Quality: quality}
 	if err := jpeg.Encode(&out, img, opts); err != nil {
 		fmt.Printf("Could not encode image as JPEG: %s\n", err)
+		return
+	}
+
+	data := out.Bytes()
+	var segments [][]byte
+	if len(m.exif) > 0 {
+		segments = append(segments, buildJPEGApp1Segment(exifSegmentMarker, m.exif))
+	}
+	if len(m.xmp) > 0 {
+		segments = append(segments, buildJPEGApp1Segment(xmpSegmentMarker, m.xmp))
+	}
+	segments = append(segments, buildJPEGICCSegments(m.icc)...)
+	if len(segments) > 0 {
+		data = injectJPEGSegments(data, segments...)
+	}
+
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		fmt.Printf("Could not save JPEG image as %s: %s\n", filename, err)
 	} else {
-		if err := os.WriteFile(filename, out.Bytes(), 0644); err != nil {
-			fmt.Printf("Could not save JPEG image as %s: %s\n", filename, err)
-		} else {
-			fmt.Printf("HEIC image saved as %s\n", filename)
-		}
+		fmt.Printf("HEIC image saved as %s\n", filename)
 	}
 }
 
-// Saves an image as a PNG file with the specified filename.
-func savePNG(img image.Image, filename string) {
+// Saves an image as a PNG file with the specified filename, embedding the
+// given Exif/XMP metadata unless m is empty.
+func savePNG(img image.Image, filename string, m metadata) {
 	var out bytes.Buffer
 	if err := png.Encode(&out, img); err != nil {
 		fmt.Printf("Could not encode image as PNG: %s\n", err)
+		return
+	}
+
+	data := out.Bytes()
+	chunks := buildPNGMetadataChunks(m)
+	if iccp := buildPNGiCCPChunk(m.icc); iccp != nil {
+		chunks = append(chunks, iccp)
+	}
+	if len(chunks) > 0 {
+		data = injectPNGChunks(data, chunks...)
+	}
+
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		fmt.Printf("Could not save PNG image as %s: %s\n", filename, err)
 	} else {
-		if err := os.WriteFile(filename, out.Bytes(), 0644); err != nil {
-			fmt.Printf("Could not save PNG image as %s: %s\n", filename, err)
-		} else {
-			fmt.Printf("HEIC image saved as %s\n", filename)
-		}
+		fmt.Printf("HEIC image saved as %s\n", filename)
 	}
 }
 
-// Converts a HEIC file to JPEG or PNG and optionally deletes the original.
-func convertHeic(file string, outputPath string, format string, quality int, deleteOriginal bool, wg *sync.WaitGroup, start <-chan struct{}, done chan struct{}) {
-	defer wg.Done()
-	<-start // Wait for the start signal for all workers
+// Saves an image as an AVIF file by re-encoding it through libheif's AV1
+// encoder, with lossless bypassing the quality parameter entirely.
+func saveAVIF(img image.Image, filename string, quality int, lossless bool) error {
+	losslessMode := heif.LosslessModeDisabled
+	if lossless {
+		losslessMode = heif.LosslessModeEnabled
+	}
+
+	c, err := heif.EncodeFromImage(img, heif.CompressionAV1, quality, losslessMode, heif.LoggingLevelNone)
+	if err != nil {
+		return fmt.Errorf("could not encode AVIF image: %w", err)
+	}
+	if err := c.WriteToFile(filename); err != nil {
+		return fmt.Errorf("could not save AVIF image as %s: %w", filename, err)
+	}
+
+	fmt.Printf("HEIC image saved as %s\n", filename)
+	return nil
+}
+
+// Saves an image as a WebP file, with lossless bypassing the quality parameter.
+func saveWebP(img image.Image, filename string, quality int, lossless bool) error {
+	var out bytes.Buffer
+	opts := &webp.Options{Lossless: lossless, Quality: float32(quality)}
+	if err := webp.Encode(&out, img, opts); err != nil {
+		return fmt.Errorf("could not encode image as WebP: %w", err)
+	}
+	if err := os.WriteFile(filename, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not save WebP image as %s: %w", filename, err)
+	}
+
+	fmt.Printf("HEIC image saved as %s\n", filename)
+	return nil
+}
+
+// Saves an image as a TIFF file using Deflate compression.
+func saveTIFF(img image.Image, filename string) error {
+	var out bytes.Buffer
+	opts := &tiff.Options{Compression: tiff.Deflate}
+	if err := tiff.Encode(&out, img, opts); err != nil {
+		return fmt.Errorf("could not encode image as TIFF: %w", err)
+	}
+	if err := os.WriteFile(filename, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not save TIFF image as %s: %w", filename, err)
+	}
+
+	fmt.Printf("HEIC image saved as %s\n", filename)
+	return nil
+}
+
+// options bundles the per-file conversion settings that stay constant across
+// an entire run, so worker goroutines only need to pass the file path around.
+type options struct {
+	outputPath             string
+	format                 string
+	quality                int
+	deleteOriginal         bool
+	stripMetadata          bool
+	preserveOrientationTag bool
+	convertToSRGB          bool
+	lossless               bool
+	extractThumbnails      bool
+	onConflict             string
+	dryRun                 bool
+}
+
+// Converts a HEIC file, which may contain several top-level images and image
+// sequences, to the requested output format and optionally deletes the
+// original. Returns an error describing why the conversion failed, or nil on
+// success.
+func convertHeic(file string, opts options) error {
+	fileData, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read file: %w", err)
+	}
+	containerMeta := parseContainerMetadata(fileData)
 
 	c, err := heif.NewContext()
 	if err != nil {
-		fmt.Printf("Could not create context: %s\n", err)
-		return
+		return fmt.Errorf("could not create context: %w", err)
 	}
 
-	if err := c.ReadFromFile(file); err != nil {
-		fmt.Printf("Could not read file %s: %s\n", file, err)
-		return
+	if err := c.ReadFromMemory(fileData); err != nil {
+		return fmt.Errorf("could not read file: %w", err)
+	}
+
+	imageIDs := c.GetListOfTopLevelImageIDs()
+	if len(imageIDs) == 0 {
+		return fmt.Errorf("no top-level images found")
+	}
+
+	baseFilename := outputBase(file, opts.outputPath)
+
+	for i, id := range imageIDs {
+		handle, err := c.GetImageHandle(id)
+		if err != nil {
+			return fmt.Errorf("could not get image handle %d: %w", id, err)
+		}
+
+		suffix := multiImageSuffix(i, len(imageIDs))
+		if err := convertImageHandle(handle, containerMeta[id], baseFilename+suffix, opts); err != nil {
+			return fmt.Errorf("image %d: %w", i+1, err)
+		}
+
+		if opts.extractThumbnails {
+			for j, thumbID := range handle.GetListOfThumbnailIDs() {
+				thumb, err := handle.GetThumbnail(thumbID)
+				if err != nil {
+					fmt.Printf("Could not get thumbnail %d of image %d in %s: %s\n", j+1, i+1, file, err)
+					continue
+				}
+				thumbFilename := thumbnailFilename(baseFilename+suffix, j)
+				if err := convertImageHandle(thumb, containerMeta[thumbID], thumbFilename, opts); err != nil {
+					fmt.Printf("Could not convert thumbnail %d of image %d in %s: %s\n", j+1, i+1, file, err)
+				}
+			}
+		}
+	}
+
+	if opts.deleteOriginal {
+		if opts.dryRun {
+			fmt.Printf("[dry-run] would delete original file: %s\n", file)
+		} else if err := os.Remove(file); err != nil {
+			return fmt.Errorf("converted but failed to delete original: %w", err)
+		} else {
+			fmt.Printf("Deleted original file: %s\n", file)
+		}
+	}
+
+	return nil
+}
+
+// outputBase computes the extension-less output path for file, treating a
+// non-empty outputPath as the directory the converted file is placed into. Unlike
+// the naive strings.Replace(file, ".", "_", 1) it once used, this is safe for
+// paths containing dots outside the extension (e.g. "/home/user.name/pic.heic")
+// and always joins outputPath with filepath.Join instead of relying on the
+// caller to supply a trailing slash.
+func outputBase(file string, outputPath string) string {
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	if outputPath != "" {
+		base = filepath.Join(outputPath, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+	}
+	return base
+}
+
+// multiImageSuffix returns the "_N" suffix appended to a top-level image's
+// output filename when a HEIC file contains more than one image, or "" for
+// a single-image file so its output keeps the plain base filename.
+func multiImageSuffix(index, count int) string {
+	if count <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("_%d", index+1)
+}
+
+// thumbnailFilename returns the output filename for the thumbIndex'th (0-based)
+// thumbnail of the image whose own output base (including any multiImageSuffix) is base.
+func thumbnailFilename(base string, thumbIndex int) string {
+	return fmt.Sprintf("%s_thumb%d", base, thumbIndex+1)
+}
+
+// formatExtensions maps a --format value to the file extension used for its output.
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"avif": ".avif",
+	"webp": ".webp",
+	"tiff": ".tiff",
+}
+
+// targetMu serializes the stat-then-reserve conflict checks below so that
+// concurrent workers (main runs --workers of these, NumCPU by default)
+// can never both observe the same candidate path as free and collide on the
+// same output file under --on-conflict=skip or --on-conflict=rename.
+var targetMu sync.Mutex
+
+// resolveTarget applies opts.onConflict to the candidate output path,
+// returning the final path to write to and whether the write should be
+// skipped entirely (already exists under the "skip" policy, or --dry-run).
+// For "skip" and "rename" the returned path is reserved (created empty,
+// O_EXCL) under targetMu before this function returns, so no other worker
+// can resolve to the same target; the later save path simply overwrites
+// the reserved placeholder. --dry-run never reserves, since it never writes.
+func resolveTarget(candidate string, img image.Image, opts options) (target string, skip bool, err error) {
+	target = candidate
+	existsSkip := false
+
+	switch opts.onConflict {
+	case "hash":
+		target = contentAddressedPath(filepath.Dir(candidate), img, filepath.Ext(candidate))
+	case "skip":
+		if opts.dryRun {
+			if _, err := os.Stat(candidate); err == nil {
+				existsSkip = true
+			}
+			break
+		}
+		reserved, reserveErr := reservePath(candidate)
+		if reserveErr != nil {
+			return target, false, fmt.Errorf("could not reserve output path %s: %w", candidate, reserveErr)
+		}
+		existsSkip = !reserved
+	case "rename":
+		if opts.dryRun {
+			if _, err := os.Stat(candidate); err == nil {
+				target = nextAvailableName(candidate)
+			}
+			break
+		}
+		if target, err = reserveAvailableName(candidate); err != nil {
+			return candidate, false, fmt.Errorf("could not reserve output path: %w", err)
+		}
+	}
+
+	if opts.dryRun {
+		if existsSkip {
+			fmt.Printf("[dry-run] would skip %s: output already exists\n", target)
+		} else {
+			fmt.Printf("[dry-run] would write %s\n", target)
+		}
+		return target, true, nil
+	}
+
+	if existsSkip {
+		return target, true, nil
+	}
+
+	return target, false, nil
+}
+
+// reservePath atomically claims path by creating it if, and only if, it does
+// not already exist, so two concurrent resolveTarget calls can never both
+// treat the same missing path as free. It reports whether the reservation
+// succeeded; false means path already existed.
+func reservePath(path string) (reserved bool, err error) {
+	targetMu.Lock()
+	defer targetMu.Unlock()
+	return tryReserve(path)
+}
+
+// nextAvailableName appends "_1", "_2", ... before the extension of path
+// until it finds one that does not already exist.
+func nextAvailableName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, n, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// reserveAvailableName behaves like nextAvailableName but atomically claims
+// the chosen path before returning it, so two concurrent callers can never
+// be handed the same "_N" suffix for the same base path.
+func reserveAvailableName(path string) (string, error) {
+	targetMu.Lock()
+	defer targetMu.Unlock()
+
+	if reserved, err := tryReserve(path); err != nil {
+		return "", err
+	} else if reserved {
+		return path, nil
 	}
 
-	handle, err := c.GetPrimaryImageHandle()
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, n, ext)
+		reserved, err := tryReserve(candidate)
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			return candidate, nil
+		}
+	}
+}
+
+// tryReserve attempts to atomically create path via O_EXCL, claiming it for
+// the caller. It reports (false, nil) if path already exists rather than
+// treating that as an error.
+func tryReserve(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		fmt.Printf("Could not get primary image: %s\n", err)
-		return
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	f.Close()
+	return true, nil
+}
+
+// contentAddressedPath returns a "<root>/content/<hh>/<hash><ext>" path keyed
+// on the md5 of img's decoded pixels, so identical captures dedup into one file.
+func contentAddressedPath(root string, img image.Image, ext string) string {
+	hash := hashImagePixels(img)
+	return filepath.Join(root, "content", hash[:2], hash+ext)
+}
+
+// hashImagePixels returns the hex-encoded md5 digest of img's raw RGBA pixels.
+func hashImagePixels(img image.Image) string {
+	h := md5.New()
+	b := img.Bounds()
+	px := make([]byte, 8)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			px[0], px[1] = byte(r>>8), byte(r)
+			px[2], px[3] = byte(g>>8), byte(g)
+			px[4], px[5] = byte(bl>>8), byte(bl)
+			px[6], px[7] = byte(a>>8), byte(a)
+			h.Write(px)
+		}
 	}
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	fmt.Printf("Converting file: %s image size: %v Ã— %v\n", file, handle.GetWidth(), handle.GetHeight())
+// convertImageHandle decodes a single HEIF image handle (a top-level image or
+// a thumbnail), applies metadata/color handling from itemMeta (that item's
+// Exif/XMP/ICC entry from parseContainerMetadata), resolves the output path
+// against opts.onConflict/--dry-run, and writes it in opts.format to the
+// resolved path (outFilename plus the format's extension, renamed or
+// content-addressed as the policy requires).
+func convertImageHandle(handle *heif.ImageHandle, itemMeta metadata, outFilename string, opts options) error {
+	fmt.Printf("Converting image: %s image size: %v Ã— %v\n", outFilename, handle.GetWidth(), handle.GetHeight())
 	img, err := handle.DecodeImage(heif.ColorspaceUndefined, heif.ChromaUndefined, nil)
 	if err != nil {
-		fmt.Printf("Could not decode image: %s\n", err)
-	} else if i, err := img.GetImage(); err != nil {
-		fmt.Printf("Could not get image: %s\n", err)
-	} else {
-		outFilename := strings.Replace(file, ".", "_", 1)
-		if outputPath != "" {
-			filename := filepath.Base(file)
-			outFilename = outputPath + strings.Replace(filename, ".", "_", 1)
+		return fmt.Errorf("could not decode image: %w", err)
+	}
+	i, err := img.GetImage()
+	if err != nil {
+		return fmt.Errorf("could not get image: %w", err)
+	}
+
+	var m metadata
+	if !opts.stripMetadata {
+		m.exif = itemMeta.exif
+		m.xmp = itemMeta.xmp
+		m.icc = itemMeta.icc
+		if !opts.preserveOrientationTag {
+			if orientation := exifOrientation(m.exif); orientation != 1 {
+				i = applyOrientation(i, orientation)
+				m.exif = normalizeExifOrientation(m.exif)
+			}
 		}
+	}
 
-		switch format {
-		case "jpeg":
-			saveJPEG(i, outFilename + ".jpg", quality)
-		case "png":
-			savePNG(i, outFilename + ".png")
-		default:
-			fmt.Printf("Unsupported format: %s\n", format)
-			return
+	if opts.convertToSRGB && itemMeta.displayP3 {
+		i = convertDisplayP3ToSRGB(i)
+		m.icc = nil // pixels are now sRGB, no profile needs to travel with them
+	}
+
+	ext, ok := formatExtensions[opts.format]
+	if !ok {
+		return fmt.Errorf("unsupported format: %s", opts.format)
+	}
+
+	target, skip, err := resolveTarget(outFilename+ext, i, opts)
+	if err != nil {
+		return fmt.Errorf("could not resolve output path: %w", err)
+	}
+	if skip {
+		if !opts.dryRun {
+			fmt.Printf("Skipping %s: output already exists\n", target)
 		}
+		return nil
 	}
 
-	if deleteOriginal {
-		if err := os.Remove(file); err != nil {
-			fmt.Printf("Failed to delete original file %s: %v", file, err)
-		} else {
-			fmt.Printf("Deleted original file: %s", file)
+	if dir := filepath.Dir(target); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("could not create output directory %s: %w", dir, err)
 		}
 	}
 
-	<-done // Release a slot in the semaphore
+	switch opts.format {
+	case "jpeg":
+		saveJPEG(i, target, opts.quality, m)
+	case "png":
+		savePNG(i, target, m)
+	case "avif":
+		return saveAVIF(i, target, opts.quality, opts.lossless)
+	case "webp":
+		return saveWebP(i, target, opts.quality, opts.lossless)
+	case "tiff":
+		return saveTIFF(i, target)
+	}
+
+	return nil
+}
+
+// jobResult reports the outcome of converting a single file, for the
+// reporter goroutine to tally into the end-of-run summary.
+type jobResult struct {
+	file    string
+	err     error
+	skipped bool
+}
+
+// convertFunc performs the actual per-file conversion invoked by worker. It
+// is a variable, defaulting to convertHeic, so tests can substitute a fake
+// to observe the worker pool's concurrency without decoding real HEIC files.
+var convertFunc = convertHeic
+
+// worker pulls file paths off jobs until it is closed, converts each one,
+// and reports the outcome on results. Long-lived: NumCPUs (or --workers)
+// of these run for the lifetime of the program instead of one goroutine per file.
+func worker(jobs <-chan string, results chan<- jobResult, opts options, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for file := range jobs {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			results <- jobResult{file: file, skipped: true, err: fmt.Errorf("file does not exist")}
+			continue
+		}
+		results <- jobResult{file: file, err: convertFunc(file, opts)}
+	}
 }
 
 // Finds all HEIC files in a directory and returns their paths.
@@ -143,51 +1494,136 @@ func FindHeicFiles(directory string) ([]string, error) {
 	return heicFiles, err
 }
 
+// collectFiles resolves --input_file/--input_dir flags and an optional
+// newline-delimited file list piped over stdin into a single, order-preserving
+// list of files to convert.
+func collectFiles(inputFiles, inputDirs []string) []string {
+	var files []string
+
+	for _, f := range inputFiles {
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			fmt.Printf("Input file '%s' does not exist.\n", f)
+			continue
+		}
+		files = append(files, f)
+	}
+
+	for _, dir := range inputDirs {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			fmt.Printf("Input directory '%s' does not exist.\n", dir)
+			continue
+		}
+		found, err := FindHeicFiles(dir)
+		if err != nil {
+			fmt.Printf("Error finding HEIC files in %s: %v\n", dir, err)
+			continue
+		}
+		files = append(files, found...)
+	}
+
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				files = append(files, line)
+			}
+		}
+	}
+
+	return files
+}
+
 func main() {
-	inputFile := flag.String("input_file", "", "Path to a single .HEIC file to be converted.")
-	inputDir := flag.String("input_dir", "", "Path to a directory containing .HEIC files.")
+	var inputFiles, inputDirs stringListFlag
+	flag.Var(&inputFiles, "input_file", "Path to a single .HEIC file to be converted. May be repeated.")
+	flag.Var(&inputDirs, "input_dir", "Path to a directory containing .HEIC files. May be repeated.")
 	outputPath := flag.String("output_path", "", "Path to the output file or directory.")
 	deleteOriginal := flag.Bool("delete", false, "Delete the original file after conversion.")
-	format := flag.String("format", "jpeg", "Output image format (jpeg or png).")
+	format := flag.String("format", "jpeg", "Output image format (jpeg, png, avif, webp, or tiff).")
 	quality := flag.Int("quality", 80, "Quality of the output image (1-100).")
+	stripMetadata := flag.Bool("strip-metadata", false, "Discard Exif/XMP metadata instead of copying it to the output file.")
+	preserveOrientationTag := flag.Bool("preserve-orientation-tag", false, "Keep pixels as decoded and only copy the Exif Orientation tag, instead of auto-rotating.")
+	convertToSRGB := flag.Bool("convert-to-srgb", false, "Convert Display P3 images to sRGB instead of embedding the source ICC profile.")
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of files to convert concurrently.")
+	lossless := flag.Bool("lossless", false, "Use lossless encoding for formats that support it (avif, webp), bypassing --quality.")
+	extractThumbnails := flag.Bool("extract-thumbnails", false, "Also extract and convert embedded thumbnails.")
+	onConflict := flag.String("on-conflict", "overwrite", "How to handle an existing output file: skip, overwrite, rename, or hash.")
+	dryRun := flag.Bool("dry-run", false, "Print planned operations without writing any files.")
 
 	flag.Parse()
 
-	NumCPUs := runtime.NumCPU() // Maximum number of goroutines running concurrently
-	fmt.Printf("Number of CPUs: %d\n", NumCPUs)
+	switch *onConflict {
+	case "skip", "overwrite", "rename", "hash":
+	default:
+		fmt.Printf("Invalid --on-conflict value %q: must be skip, overwrite, rename, or hash.\n", *onConflict)
+		return
+	}
+
+	files := collectFiles(inputFiles, inputDirs)
+	if len(files) == 0 {
+		fmt.Println("No files to convert. Specify --input_file, --input_dir, or pipe a file list on stdin.")
+		return
+	}
+
+	numWorkers := *workers
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	fmt.Printf("Converting %d file(s) with %d worker(s)\n", len(files), numWorkers)
+
+	opts := options{
+		outputPath:             *outputPath,
+		format:                 *format,
+		quality:                *quality,
+		deleteOriginal:         *deleteOriginal,
+		stripMetadata:          *stripMetadata,
+		preserveOrientationTag: *preserveOrientationTag,
+		convertToSRGB:          *convertToSRGB,
+		lossless:               *lossless,
+		extractThumbnails:      *extractThumbnails,
+		onConflict:             *onConflict,
+		dryRun:                 *dryRun,
+	}
 
-	done := make(chan struct{}, NumCPUs)
-	start := make(chan struct{})
+	jobs := make(chan string, len(files))
+	results := make(chan jobResult, len(files))
 	var wg sync.WaitGroup
 
-	if *inputFile != "" {
-		if _, err := os.Stat(*inputFile); os.IsNotExist(err) {
-			fmt.Printf("Input file '%s' does not exist.", *inputFile)
-		}
+	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
-		done <- struct{}{}
-		go convertHeic(*inputFile, *outputPath, *format, *quality, *deleteOriginal, &wg, start, done)
-	} else if *inputDir != "" {
-		if _, err := os.Stat(*inputDir); os.IsNotExist(err) {
-			fmt.Printf("Input directory '%s' does not exist.", *inputDir)
-		}
-		files, err := FindHeicFiles(*inputDir)
-		if err != nil {
-			fmt.Printf("Error finding HEIC files: %v", err)
-		}
-		for _, file := range files {
-			wg.Add(1)
-			go func() {
-				done <- struct{}{} //Reserve a slot in the semaphore
-				convertHeic(file, *outputPath, *format, *quality, *deleteOriginal, &wg, start, done)
-			}()
-		}
-	} else {
-		fmt.Println("Either --input_file or --input_dir must be specified.")
+		go worker(jobs, results, opts, &wg)
+	}
+	for _, file := range files {
+		jobs <- file
 	}
+	close(jobs)
 
-	close(start) // Send the start signal to all workers
-	wg.Wait()    // Wait for all workers to finish
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-	fmt.Println("All conversions completed.")
+	var succeeded, failed, skipped int
+	var failures []jobResult
+	for res := range results {
+		switch {
+		case res.skipped:
+			skipped++
+		case res.err != nil:
+			failed++
+			failures = append(failures, res)
+		default:
+			succeeded++
+		}
+		done := succeeded + failed + skipped
+		fmt.Printf("Progress: %d/%d done (%d ok, %d failed, %d skipped)\n", done, len(files), succeeded, failed, skipped)
+	}
+
+	fmt.Printf("All conversions completed: %d ok, %d failed, %d skipped\n", succeeded, failed, skipped)
+	if len(failures) > 0 {
+		fmt.Println("Failures:")
+		for _, f := range failures {
+			fmt.Printf("  %s: %s\n", f.file, f.err)
+		}
+	}
 }
@@ -0,0 +1,749 @@
+/*
+Copyright (c) 2025 hprombex
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM,
+DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE
+OR OTHER DEALINGS IN THE SOFTWARE.
+
+Author: hprombex
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chai2010/webp"
+	"golang.org/x/image/tiff"
+)
+
+func TestBuildJPEGICCSegmentsSingleChunk(t *testing.T) {
+	icc := make([]byte, 100)
+	segments := buildJPEGICCSegments(icc)
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %d", len(segments))
+	}
+	assertValidICCSegment(t, segments[0], 1, 1, 100)
+}
+
+func TestBuildJPEGICCSegmentsChunkBoundary(t *testing.T) {
+	// A profile exactly iccSegmentMaxSize bytes long must fit in a single
+	// segment whose declared length never exceeds the 64KB APP2 limit.
+	icc := make([]byte, iccSegmentMaxSize)
+	segments := buildJPEGICCSegments(icc)
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 segment at the boundary, got %d", len(segments))
+	}
+	assertValidICCSegment(t, segments[0], 1, 1, iccSegmentMaxSize)
+
+	// One byte past the boundary must spill into a second chunk instead of
+	// producing a segment whose length field overflows a uint16.
+	icc = make([]byte, iccSegmentMaxSize+1)
+	segments = buildJPEGICCSegments(icc)
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments just past the boundary, got %d", len(segments))
+	}
+	assertValidICCSegment(t, segments[0], 1, 2, iccSegmentMaxSize)
+	assertValidICCSegment(t, segments[1], 2, 2, 1)
+}
+
+// assertValidICCSegment checks that seg is a well-formed APP2 "ICC_PROFILE"
+// segment: its declared length matches its actual size and fits in 64KB, its
+// sequence/total numbering bytes are correct, and it carries wantDataLen
+// bytes of ICC payload.
+func assertValidICCSegment(t *testing.T, seg []byte, wantSeq, wantTotal, wantDataLen int) {
+	t.Helper()
+
+	if len(seg) < 4 || seg[0] != 0xFF || seg[1] != 0xE2 {
+		t.Fatalf("segment missing APP2 marker: % x", seg[:min(len(seg), 4)])
+	}
+
+	declaredLen := int(seg[2])<<8 | int(seg[3])
+	actualLen := len(seg) - 2 // the length field covers everything after itself
+	if declaredLen != actualLen {
+		t.Fatalf("declared length %d does not match actual segment length %d", declaredLen, actualLen)
+	}
+	if declaredLen > 65535 {
+		t.Fatalf("declared length %d overflows the JPEG segment length field", declaredLen)
+	}
+
+	content := seg[4:]
+	marker := string(content[:len(iccProfileMarker)])
+	if marker != iccProfileMarker {
+		t.Fatalf("expected ICC_PROFILE marker, got %q", marker)
+	}
+
+	seq, total := content[len(iccProfileMarker)], content[len(iccProfileMarker)+1]
+	if int(seq) != wantSeq || int(total) != wantTotal {
+		t.Fatalf("got seq/total %d/%d, want %d/%d", seq, total, wantSeq, wantTotal)
+	}
+
+	data := content[len(iccProfileMarker)+2:]
+	if len(data) != wantDataLen {
+		t.Fatalf("got %d bytes of ICC data, want %d", len(data), wantDataLen)
+	}
+}
+
+// tiffIFD builds a minimal Exif blob (TIFF header + one IFD with a single
+// Orientation entry) in the given byte order, for exercising exifOrientation.
+func tiffIFD(order binaryOrder, orientation uint16) []byte {
+	put16 := func(v uint16) []byte {
+		if order == littleEndian {
+			return []byte{byte(v), byte(v >> 8)}
+		}
+		return []byte{byte(v >> 8), byte(v)}
+	}
+	put32 := func(v uint32) []byte {
+		if order == littleEndian {
+			return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+		}
+		return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+
+	var buf []byte
+	if order == littleEndian {
+		buf = append(buf, "II"...)
+	} else {
+		buf = append(buf, "MM"...)
+	}
+	buf = append(buf, put16(42)...)
+	buf = append(buf, put32(8)...) // IFD starts right after the header
+
+	buf = append(buf, put16(1)...) // one entry
+	buf = append(buf, put16(0x0112)...)
+	buf = append(buf, put16(3)...) // type SHORT
+	buf = append(buf, put32(1)...) // count
+	buf = append(buf, put16(orientation)...)
+	buf = append(buf, 0, 0) // pad the 4-byte value slot
+
+	return buf
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		name  string
+		order binaryOrder
+	}{
+		{"little-endian", littleEndian},
+		{"big-endian", bigEndian},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for orientation := uint16(1); orientation <= 8; orientation++ {
+				got := exifOrientation(tiffIFD(tt.order, orientation))
+				if got != int(orientation) {
+					t.Errorf("orientation %d: got %d", orientation, got)
+				}
+			}
+		})
+	}
+}
+
+func TestExifOrientationDefaultsToOne(t *testing.T) {
+	for _, exif := range [][]byte{nil, []byte("short"), []byte("XX\x00\x00\x00\x00\x00\x00")} {
+		if got := exifOrientation(exif); got != 1 {
+			t.Errorf("exifOrientation(%q) = %d, want 1", exif, got)
+		}
+	}
+}
+
+// labeledImage builds a w x h RGBA image where every pixel has a distinct
+// color, so rotations/flips can be verified by tracking where each color ends up.
+func labeledImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0, A: 255})
+		}
+	}
+	return img
+}
+
+func at(img image.Image, x, y int) (int, int) {
+	r, g, _, _ := img.At(x, y).RGBA()
+	return int(r >> 8), int(g >> 8)
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 source lets rotations (which swap width/height) be told apart
+	// from flips (which don't).
+	src := labeledImage(3, 2)
+
+	tests := []struct {
+		orientation int
+		wantW       int
+		wantH       int
+		check       func(t *testing.T, got image.Image)
+	}{
+		{1, 3, 2, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 0, 0) }},
+		{2, 3, 2, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 2, 0) }}, // flip horizontal
+		{3, 3, 2, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 2, 1) }}, // rotate 180
+		{4, 3, 2, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 0, 1) }}, // flip vertical
+		{5, 2, 3, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 0, 0) }}, // transpose
+		{6, 2, 3, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 0, 1) }}, // rotate 90 CW
+		{7, 2, 3, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 2, 1) }}, // transverse
+		{8, 2, 3, func(t *testing.T, got image.Image) { requirePixel(t, got, 0, 0, 2, 0) }}, // rotate 270 CW
+	}
+
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+		b := got.Bounds()
+		if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("orientation %d: got size %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			continue
+		}
+		tt.check(t, got)
+	}
+}
+
+func requirePixel(t *testing.T, img image.Image, x, y, wantR, wantG int) {
+	t.Helper()
+	gotR, gotG := at(img, x, y)
+	if gotR != wantR || gotG != wantG {
+		t.Errorf("pixel (%d,%d) = (%d,%d), want (%d,%d)", x, y, gotR, gotG, wantR, wantG)
+	}
+}
+
+func putBE16(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+
+func putBE32(v uint32) []byte { return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+
+// isoBox wraps payload in an ISO-BMFF box header of the given 4-character type.
+func isoBox(boxType string, payload []byte) []byte {
+	box := append(putBE32(uint32(8+len(payload))), boxType...)
+	return append(box, payload...)
+}
+
+// fullBox prepends the version/flags header shared by every ISO-BMFF "FullBox".
+func fullBox(version byte, payload []byte) []byte {
+	return append([]byte{version, 0, 0, 0}, payload...)
+}
+
+// buildTestHeic assembles a minimal but complete synthetic HEIC container: a
+// "meta" box describing one image item (id 1) with an Exif item (id 2), an
+// XMP item (id 3), and a Display-P3 "colr" property, each item's iloc extent
+// pointing at real bytes appended after the meta box.
+func buildTestHeic() (fileData []byte, exifPayload, xmpPayload []byte) {
+	exifPayload = []byte("EXIFDATA")
+	xmpPayload = []byte("<x:xmpmeta/>")
+
+	exifItem := append([]byte{0, 0, 0, 0}, exifPayload...) // 4-byte TIFF offset prefix
+
+	infeExif := fullBox(2, append(append(putBE16(2), 0, 0), "Exif"...))
+	infeXMP := fullBox(2, append(append(append(putBE16(3), 0, 0), "mime"...), append([]byte{0}, append([]byte("application/rdf+xml"), 0)...)...))
+	iinf := isoBox("iinf", fullBox(0, append(putBE16(2), append(isoBox("infe", infeExif), isoBox("infe", infeXMP)...)...)))
+
+	// meta box header + iinf + iloc + iref + iprp are all siblings inside
+	// "meta"; iloc's extent offsets are absolute offsets into fileData, so
+	// they're patched in below once the meta box's total size is known.
+	ilocHeader := fullBox(0, []byte{0x44, 0x00}) // offsetSize=4, lengthSize=4, baseOffsetSize=0, indexSize=0
+	ilocHeader = append(ilocHeader, putBE16(2)...)
+	ilocEntry := func(itemID uint16, offset, length uint32) []byte {
+		b := append(putBE16(itemID), 0, 0) // data_reference_index
+		b = append(b, putBE16(1)...)       // extent_count
+		b = append(b, putBE32(offset)...)
+		b = append(b, putBE32(length)...)
+		return b
+	}
+
+	iref := isoBox("iref", fullBox(0, append(
+		isoBox("cdsc", append(append(putBE16(2), putBE16(1)...), putBE16(1)...)),
+		isoBox("cdsc", append(append(putBE16(3), putBE16(1)...), putBE16(1)...))...,
+	)))
+
+	colr := isoBox("colr", append([]byte("nclx"), putBE16(12)...))
+	ipco := isoBox("ipco", colr)
+	ipma := isoBox("ipma", fullBox(0, append(putBE32(1), append(putBE16(1), 1, 0x01)...)))
+	iprp := isoBox("iprp", append(ipco, ipma...))
+
+	// Placeholder iloc entries; offsets are filled in once we know where the
+	// exif/xmp bytes will land in the final file.
+	ilocPlaceholder := append(append([]byte{}, ilocHeader...), append(ilocEntry(2, 0, uint32(len(exifItem))), ilocEntry(3, 0, uint32(len(xmpPayload)))...)...)
+	metaPayload := fullBox(0, append(append(append(iinf, isoBox("iloc", ilocPlaceholder)...), iref...), iprp...))
+	metaBox := isoBox("meta", metaPayload)
+
+	exifOffset := uint32(len(metaBox))
+	xmpOffset := exifOffset + uint32(len(exifItem))
+
+	iloc := append(append([]byte{}, ilocHeader...), append(ilocEntry(2, exifOffset, uint32(len(exifItem))), ilocEntry(3, xmpOffset, uint32(len(xmpPayload)))...)...)
+	metaPayload = fullBox(0, append(append(append(iinf, isoBox("iloc", iloc)...), iref...), iprp...))
+	metaBox = isoBox("meta", metaPayload)
+
+	fileData = append(append(append([]byte{}, metaBox...), exifItem...), xmpPayload...)
+	return fileData, exifPayload, xmpPayload
+}
+
+func TestParseContainerMetadata(t *testing.T) {
+	fileData, exifPayload, xmpPayload := buildTestHeic()
+
+	got := parseContainerMetadata(fileData)
+	m, ok := got[1]
+	if !ok {
+		t.Fatalf("no metadata found for item 1; got %#v", got)
+	}
+	if string(m.exif) != string(exifPayload) {
+		t.Errorf("exif = %q, want %q", m.exif, exifPayload)
+	}
+	if string(m.xmp) != string(xmpPayload) {
+		t.Errorf("xmp = %q, want %q", m.xmp, xmpPayload)
+	}
+	if !m.displayP3 {
+		t.Errorf("displayP3 = false, want true (nclx primaries 12)")
+	}
+}
+
+func TestNextIsoBoxRejectsTruncatedBox(t *testing.T) {
+	if _, _, _, ok := nextIsoBox([]byte{0, 0, 0, 1}); ok {
+		t.Errorf("nextIsoBox accepted a header shorter than 8 bytes")
+	}
+	// A declared size larger than the available data must be rejected too.
+	box := append(putBE32(100), []byte("free")...)
+	if _, _, _, ok := nextIsoBox(box); ok {
+		t.Errorf("nextIsoBox accepted a box whose declared size exceeds the input")
+	}
+}
+
+func TestOutputBase(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		outputPath string
+		want       string
+	}{
+		{"no output dir", "/home/pics/photo.heic", "", "/home/pics/photo"},
+		{"dots outside the extension", "/home/user.name/pic.heic", "", "/home/user.name/pic"},
+		{"joined with output dir", "/home/pics/photo.heic", "/tmp/out", filepath.Join("/tmp/out", "photo")},
+		{"output dir strips source dir's dots too", "/home/user.name/pic.heic", "/tmp/out", filepath.Join("/tmp/out", "pic")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outputBase(tt.file, tt.outputPath); got != tt.want {
+				t.Errorf("outputBase(%q, %q) = %q, want %q", tt.file, tt.outputPath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextAvailableName(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photo.jpg")
+
+	if got := nextAvailableName(path); got != filepath.Join(dir, "photo_1.jpg") {
+		t.Fatalf("with no existing files, got %q", got)
+	}
+
+	os.WriteFile(filepath.Join(dir, "photo_1.jpg"), nil, 0644)
+	if got := nextAvailableName(path); got != filepath.Join(dir, "photo_2.jpg") {
+		t.Fatalf("with photo_1.jpg present, got %q", got)
+	}
+}
+
+// captureStdout redirects os.Stdout for the duration of fn and returns
+// whatever it wrote.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	orig := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	os.Stdout = w
+	fn()
+	w.Close()
+	os.Stdout = orig
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading captured stdout: %v", err)
+	}
+	return string(out)
+}
+
+func TestResolveTargetSkipExisting(t *testing.T) {
+	dir := t.TempDir()
+	candidate := filepath.Join(dir, "photo.jpg")
+	os.WriteFile(candidate, nil, 0644)
+
+	target, skip, err := resolveTarget(candidate, nil, options{onConflict: "skip"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !skip || target != candidate {
+		t.Fatalf("got target=%q skip=%v, want target=%q skip=true", target, skip, candidate)
+	}
+}
+
+func TestResolveTargetSkipDryRunReportsReason(t *testing.T) {
+	dir := t.TempDir()
+	candidate := filepath.Join(dir, "photo.jpg")
+	os.WriteFile(candidate, nil, 0644)
+
+	var skip bool
+	out := captureStdout(t, func() {
+		var err error
+		_, skip, err = resolveTarget(candidate, nil, options{onConflict: "skip", dryRun: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	if !skip {
+		t.Fatalf("expected skip=true")
+	}
+	if !strings.Contains(out, "already exists") {
+		t.Errorf("dry-run output %q does not report the skip reason", out)
+	}
+}
+
+func TestResolveTargetDryRunWrite(t *testing.T) {
+	dir := t.TempDir()
+	candidate := filepath.Join(dir, "photo.jpg")
+
+	var target string
+	var skip bool
+	out := captureStdout(t, func() {
+		var err error
+		target, skip, err = resolveTarget(candidate, nil, options{dryRun: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	if !skip || target != candidate {
+		t.Fatalf("got target=%q skip=%v, want target=%q skip=true", target, skip, candidate)
+	}
+	if !strings.Contains(out, "would write") {
+		t.Errorf("dry-run output %q does not report the planned write", out)
+	}
+}
+
+func TestResolveTargetRename(t *testing.T) {
+	dir := t.TempDir()
+	candidate := filepath.Join(dir, "photo.jpg")
+	os.WriteFile(candidate, nil, 0644)
+
+	target, skip, err := resolveTarget(candidate, nil, options{onConflict: "rename"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if skip {
+		t.Fatalf("rename policy should never skip")
+	}
+	if want := filepath.Join(dir, "photo_1.jpg"); target != want {
+		t.Errorf("got target %q, want %q", target, want)
+	}
+}
+
+func TestResolveTargetHashIsStableForIdenticalPixels(t *testing.T) {
+	dir := t.TempDir()
+	imgA := labeledImage(2, 2)
+	imgB := labeledImage(2, 2)
+
+	targetA, _, err := resolveTarget(filepath.Join(dir, "a.jpg"), imgA, options{onConflict: "hash"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	targetB, _, err := resolveTarget(filepath.Join(dir, "b.jpg"), imgB, options{onConflict: "hash"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if targetA != targetB {
+		t.Errorf("identical pixels hashed to different paths: %q vs %q", targetA, targetB)
+	}
+	if !strings.Contains(targetA, "content") {
+		t.Errorf("hash target %q missing the content-addressed directory", targetA)
+	}
+}
+
+func TestNormalizeExifOrientation(t *testing.T) {
+	for _, order := range []binaryOrder{littleEndian, bigEndian} {
+		exif := tiffIFD(order, 6)
+		normalized := normalizeExifOrientation(exif)
+		if got := exifOrientation(normalized); got != 1 {
+			t.Errorf("order %v: normalized orientation = %d, want 1", order, got)
+		}
+		if got := exifOrientation(exif); got != 6 {
+			t.Errorf("order %v: normalizeExifOrientation mutated its input, orientation now %d", order, got)
+		}
+	}
+}
+
+// extractJPEGApp1 walks data's marker segments (as produced by
+// injectJPEGSegments) and returns the payload of the APP1 segment carrying
+// the given marker prefix, stripped of that prefix.
+func extractJPEGApp1(data []byte, marker string) ([]byte, bool) {
+	pos := 2 // past SOI
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		segType := data[pos+1]
+		if segType == 0xDA { // start of scan: no more length-prefixed segments
+			break
+		}
+		length := int(data[pos+2])<<8 | int(data[pos+3])
+		content := data[pos+4 : pos+2+length]
+		if segType == 0xE1 && len(content) >= len(marker) && string(content[:len(marker)]) == marker {
+			return content[len(marker):], true
+		}
+		pos += 2 + length
+	}
+	return nil, false
+}
+
+func TestSaveJPEGEmbedsNormalizedOrientation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.jpg")
+
+	// This mirrors what convertImageHandle does: normalize the Orientation
+	// tag once applyOrientation has already rotated the pixels, so the
+	// embedded Exif doesn't tell viewers to rotate the image a second time.
+	exif := normalizeExifOrientation(tiffIFD(littleEndian, 6))
+	m := metadata{exif: exif, xmp: []byte("<x:xmpmeta/>")}
+
+	saveJPEG(labeledImage(4, 4), path, 90, m)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading saved JPEG: %v", err)
+	}
+
+	embeddedExif, ok := extractJPEGApp1(data, exifSegmentMarker)
+	if !ok {
+		t.Fatalf("no Exif APP1 segment found in output")
+	}
+	if got := exifOrientation(embeddedExif); got != 1 {
+		t.Errorf("embedded Exif orientation = %d, want 1", got)
+	}
+
+	embeddedXMP, ok := extractJPEGApp1(data, xmpSegmentMarker)
+	if !ok {
+		t.Fatalf("no XMP APP1 segment found in output")
+	}
+	if string(embeddedXMP) != string(m.xmp) {
+		t.Errorf("embedded XMP = %q, want %q", embeddedXMP, m.xmp)
+	}
+}
+
+func TestSaveWebP(t *testing.T) {
+	for _, lossless := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "out.webp")
+		src := labeledImage(4, 3)
+
+		if err := saveWebP(src, path, 90, lossless); err != nil {
+			t.Fatalf("lossless=%v: saveWebP: %v", lossless, err)
+		}
+
+		decoded, err := webp.Decode(mustOpen(t, path))
+		if err != nil {
+			t.Fatalf("lossless=%v: decoding saved WebP: %v", lossless, err)
+		}
+		if b := decoded.Bounds(); b.Dx() != 4 || b.Dy() != 3 {
+			t.Errorf("lossless=%v: decoded size %dx%d, want 4x3", lossless, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestSaveTIFF(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.tiff")
+	src := labeledImage(5, 2)
+
+	if err := saveTIFF(src, path); err != nil {
+		t.Fatalf("saveTIFF: %v", err)
+	}
+
+	decoded, err := tiff.Decode(mustOpen(t, path))
+	if err != nil {
+		t.Fatalf("decoding saved TIFF: %v", err)
+	}
+	if b := decoded.Bounds(); b.Dx() != 5 || b.Dy() != 2 {
+		t.Errorf("decoded size %dx%d, want 5x2", b.Dx(), b.Dy())
+	}
+}
+
+func TestSaveAVIF(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.avif")
+
+	if err := saveAVIF(labeledImage(4, 4), path, 80, false); err != nil {
+		t.Fatalf("saveAVIF: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat saved AVIF: %v", err)
+	}
+	if info.Size() == 0 {
+		t.Errorf("saved AVIF file is empty")
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestMultiImageSuffix(t *testing.T) {
+	tests := []struct {
+		index, count int
+		want         string
+	}{
+		{0, 1, ""},   // single-image file: no suffix
+		{0, 2, "_1"}, // first of several
+		{1, 2, "_2"},
+		{2, 5, "_3"},
+	}
+	for _, tt := range tests {
+		if got := multiImageSuffix(tt.index, tt.count); got != tt.want {
+			t.Errorf("multiImageSuffix(%d, %d) = %q, want %q", tt.index, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestThumbnailFilename(t *testing.T) {
+	tests := []struct {
+		base       string
+		thumbIndex int
+		want       string
+	}{
+		{"photo", 0, "photo_thumb1"},
+		{"photo_2", 2, "photo_2_thumb3"},
+	}
+	for _, tt := range tests {
+		if got := thumbnailFilename(tt.base, tt.thumbIndex); got != tt.want {
+			t.Errorf("thumbnailFilename(%q, %d) = %q, want %q", tt.base, tt.thumbIndex, got, tt.want)
+		}
+	}
+}
+
+// TestWorkerBoundsConcurrency substitutes convertFunc with a fake that blocks
+// until released, and checks that a pool of numWorkers worker() goroutines
+// never has more than numWorkers conversions running at once, proving the
+// pool is actually bounded rather than spawning a goroutine per file.
+func TestWorkerBoundsConcurrency(t *testing.T) {
+	orig := convertFunc
+	t.Cleanup(func() { convertFunc = orig })
+
+	const numWorkers = 2
+	const numJobs = 5
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	convertFunc = func(file string, opts options) error {
+		arrived <- struct{}{}
+		<-release
+		return nil
+	}
+
+	dir := t.TempDir()
+	jobs := make(chan string, numJobs)
+	results := make(chan jobResult, numJobs)
+	for i := 0; i < numJobs; i++ {
+		f := filepath.Join(dir, fmt.Sprintf("job-%d.heic", i))
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		jobs <- f
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go worker(jobs, results, options{}, &wg)
+	}
+
+	for i := 0; i < numWorkers; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for worker %d to start", i)
+		}
+	}
+
+	select {
+	case <-arrived:
+		t.Fatalf("more than %d jobs ran concurrently", numWorkers)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for i := 0; i < numJobs; i++ {
+		release <- struct{}{}
+		if i < numJobs-numWorkers {
+			select {
+			case <-arrived:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timed out waiting for the next job to start after releasing one")
+			}
+		}
+	}
+
+	wg.Wait()
+	close(results)
+	for range results {
+	}
+}
+
+// TestCollectFilesMergesFileDirAndStdin checks that collectFiles merges its
+// three input sources, in order, skips a missing --input_file instead of
+// including it, and that directory scanning only picks up .heic files.
+func TestCollectFilesMergesFileDirAndStdin(t *testing.T) {
+	dir := t.TempDir()
+
+	explicitFile := filepath.Join(dir, "explicit.heic")
+	os.WriteFile(explicitFile, nil, 0644)
+
+	subDir := filepath.Join(dir, "sub")
+	os.MkdirAll(subDir, 0755)
+	dirFile := filepath.Join(subDir, "from_dir.heic")
+	os.WriteFile(dirFile, nil, 0644)
+	os.WriteFile(filepath.Join(subDir, "ignore.txt"), nil, 0644)
+
+	stdinFile := filepath.Join(dir, "from_stdin.heic")
+	os.WriteFile(stdinFile, nil, 0644)
+
+	origStdin := os.Stdin
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	t.Cleanup(func() { os.Stdin = origStdin })
+	os.Stdin = r
+	fmt.Fprintln(w, stdinFile)
+	w.Close()
+
+	got := collectFiles([]string{explicitFile, filepath.Join(dir, "missing.heic")}, []string{subDir})
+
+	want := []string{explicitFile, dirFile, stdinFile}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("collectFiles() = %v, want %v", got, want)
+	}
+}